@@ -0,0 +1,75 @@
+// Package dbhash implements Dropbox's content hashing algorithm: a file is
+// split into 4 MiB blocks, each block is hashed with SHA-256, the block
+// hashes are concatenated in order, and that concatenation is hashed with
+// SHA-256 again. The hex encoding of the final digest is what the Dropbox
+// API calls a content_hash.
+package dbhash
+
+import (
+  "crypto/sha256"
+  "encoding/hex"
+  "hash"
+  "io"
+)
+
+// BlockSize is the size of the blocks the input is split into before each
+// is hashed individually.
+const BlockSize = 4 * 1024 * 1024
+
+type dbHash struct {
+  blockHashes []byte    // concatenated SHA-256 digests of completed blocks
+  block       hash.Hash // SHA-256 of the in-progress block
+  blockLen    int       // bytes written to block so far
+}
+
+// New returns a hash.Hash that computes a Dropbox content_hash.
+func New() hash.Hash {
+  return &dbHash{block: sha256.New()}
+}
+
+func (h *dbHash) Write(p []byte) (int, error) {
+  written := len(p)
+  for len(p) > 0 {
+    n := BlockSize - h.blockLen
+    if n > len(p) {
+      n = len(p)
+    }
+    h.block.Write(p[:n])
+    h.blockLen += n
+    p = p[n:]
+
+    if h.blockLen == BlockSize {
+      h.blockHashes = h.block.Sum(h.blockHashes)
+      h.block = sha256.New()
+      h.blockLen = 0
+    }
+  }
+  return written, nil
+}
+
+func (h *dbHash) Sum(b []byte) []byte {
+  blockHashes := h.blockHashes
+  if h.blockLen > 0 {
+    blockHashes = h.block.Sum(append([]byte(nil), h.blockHashes...))
+  }
+  sum := sha256.Sum256(blockHashes)
+  return append(b, sum[:]...)
+}
+
+func (h *dbHash) Reset() {
+  h.blockHashes = nil
+  h.block = sha256.New()
+  h.blockLen = 0
+}
+
+func (h *dbHash) Size() int      { return sha256.Size }
+func (h *dbHash) BlockSize() int { return BlockSize }
+
+// Sum reads r to completion and returns its content_hash as a hex string.
+func Sum(r io.Reader) (string, error) {
+  h := New()
+  if _, err := io.Copy(h, r); err != nil {
+    return "", err
+  }
+  return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -1,8 +1,11 @@
 package dbxapi
 
 import (
+  "context"
   "net/http"
+  "encoding/hex"
   "encoding/json"
+  "hash"
   "io"
   "io/ioutil"
   "bytes"
@@ -10,6 +13,9 @@ import (
   "errors"
   "path/filepath"
   "mime"
+
+  "github.com/rsms/go-dbxapi/dbhash"
+  "golang.org/x/oauth2"
 )
 
 type Error string
@@ -18,12 +24,43 @@ func (e Error) Error() string { return string(e) }
 
 
 type Client struct {
-  AccessToken string
-  client      http.Client
+  client   http.Client
+  pacer    Pacer
+  ts       *cachingTokenSource
+  pathRoot PathRoot
 }
 
+// NewClient creates a Client backed by a static access token. Since plain
+// Dropbox access tokens don't expire, this never refreshes; use
+// NewClientWithTokenSource with a refresh-token-backed oauth2.TokenSource
+// (e.g. from an oauth2.Config) if you need that.
 func NewClient(accessToken string) *Client {
-  return &Client{accessToken, http.Client{}}
+  return NewClientWithTokenSource(oauth2.StaticTokenSource(&oauth2.Token{AccessToken: accessToken}))
+}
+
+// NewClientWithTokenSource creates a Client whose access token is obtained
+// from ts, refreshed automatically as needed. On a 401 response, RPC and
+// Download force ts to be consulted again and retry the request once.
+func NewClientWithTokenSource(ts oauth2.TokenSource) *Client {
+  return &Client{ts: &cachingTokenSource{base: ts}, pacer: NewPacer()}
+}
+
+// SetPacer replaces the client's retry/backoff policy. All outstanding
+// requests made through this Client (RPC, Download, and the chunked upload
+// path) share the same Pacer, so a single account-wide rate limit backs off
+// every caller.
+func (c *Client) SetPacer(p Pacer) {
+  c.pacer = p
+}
+
+// WithPathRoot returns a shallow clone of c that sends pr as its
+// Dropbox-API-Path-Root header on every request, for operating against a
+// team space, a specific namespace, or another user's root in a Business
+// account. The original Client is left unmodified.
+func (c *Client) WithPathRoot(pr PathRoot) *Client {
+  c2 := *c
+  c2.pathRoot = pr
+  return &c2
 }
 
 type Timestamp struct {
@@ -120,7 +157,13 @@ type FolderEntry struct {
   // Additional information if the file is a photo or video.
   // This field is optional.
   MediaInfo *MediaInfo `json:"media_info"`
-  
+
+  // A hash of the file content, computed with the dbhash package. Only
+  // present when the request that returned this entry set
+  // include_content_hash (e.g. ListFolderReq.IncludeContentHash).
+  // This field is optional.
+  ContentHash string `json:"content_hash,omitempty"`
+
   // Set if this file is contained in a shared folder. This field is optional.
   //sharing_info FileSharingInfo?
 
@@ -217,60 +260,105 @@ const (
 )
 
 
-func (c *Client) checkRsp(rsp *http.Response, minst, maxst int) error {
-  if rsp.StatusCode >= minst && rsp.StatusCode <= maxst {
-    return nil
+// callPacer returns the client's Pacer, falling back to a fresh DefaultPacer
+// for a Client that was constructed as a struct literal rather than via
+// NewClient/NewClientWithTokenSource.
+func (c *Client) callPacer() Pacer {
+  if c.pacer == nil {
+    return NewPacer()
+  }
+  return c.pacer
+}
+
+// checkRetriableRsp reports an error describing rsp if its status code is
+// outside 2xx, consuming and closing rsp.Body in that case, and whether the
+// response is worth retrying (429, 503, or any other 5xx), and parses
+// Retry-After / rate_limit error bodies so the Pacer can honor them.
+func (c *Client) checkRetriableRsp(rsp *http.Response) (retry bool, err error) {
+  if rsp.StatusCode >= 200 && rsp.StatusCode <= 299 {
+    return false, nil
   }
   defer rsp.Body.Close()
-  // if err == nil && res.Result.Error != nil {
-  // }
   url := "?"
   if rsp.Request != nil && rsp.Request.URL != nil {
     url = rsp.Request.URL.String()
   }
-  err := errors.New(url + ": " + rsp.Status)
-  if rsp.StatusCode != 404 {
-    body, _ := ioutil.ReadAll(rsp.Body)
-    if body != nil && len(body) > 0 && len(body) < 200 {
-      err = errors.New(url + ": " + string(body))
-    }
+  baseErr := errors.New(url + ": " + rsp.Status)
+  body, _ := ioutil.ReadAll(rsp.Body)
+  if rsp.StatusCode != 404 && len(body) > 0 && len(body) < 200 {
+    baseErr = errors.New(url + ": " + string(body))
+  }
+  if pathRootErr := parseInvalidPathRoot(rsp.StatusCode, body); pathRootErr != nil {
+    return false, pathRootErr
   }
-  return err
+  return classifyRsp(rsp, body, baseErr)
 }
 
 
 func (c *Client) RPC(url string, msg, res interface{}) error {
+  return c.RPCCtx(context.Background(), url, msg, res)
+}
+
+// RPCCtx is RPC with a context that aborts the in-flight HTTP request (and
+// any retries the Pacer would otherwise attempt) as soon as it's canceled.
+func (c *Client) RPCCtx(ctx context.Context, url string, msg, res interface{}) error {
   b, err := json.Marshal(msg)
   if err != nil {
     return err
   }
-  r, err := http.NewRequest("POST", url, bytes.NewBuffer(b))
-  if len(url) > len(apiURLPrefix) && url[0:len(apiURLPrefix)] == apiURLPrefix {
-    r.Header.Add("Authorization", "Bearer " + c.AccessToken)
-  }
-  r.Header.Add("Content-Type", "application/json")
-  r.ContentLength = int64(len(b))
-  rsp, err := c.client.Do(r)
-  if err != nil {
-    return err
-  }
+  isAPICall := len(url) > len(apiURLPrefix) && url[0:len(apiURLPrefix)] == apiURLPrefix
+
+  return c.callPacer().Call(func() (bool, error) {
+    rsp, err := c.doAuthed(ctx, func(ctx context.Context, token string) (*http.Request, error) {
+      r, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(b))
+      if err != nil {
+        return nil, err
+      }
+      if isAPICall {
+        r.Header.Add("Authorization", "Bearer " + token)
+      }
+      r.Header.Add("Content-Type", "application/json")
+      if h := c.pathRoot.header(); h != "" {
+        r.Header.Add("Dropbox-API-Path-Root", h)
+      }
+      r.ContentLength = int64(len(b))
+      return r, nil
+    })
+    if err != nil {
+      if ctx.Err() != nil {
+        return false, ctx.Err()
+      }
+      return true, err
+    }
 
-  if err := c.checkRsp(rsp, 200, 299); err != nil {
-    return err
-  }
+    // Dropbox reports business-logic errors (e.g. list_folder/continue's
+    // "reset", or a path/not_found) as HTTP 409 with the error in the JSON
+    // body, not as HTTP 200 with a Result.Error field populated. For
+    // endpoints whose result type embeds Result, decode the body into res
+    // the same way a 2xx response would be, so callers can inspect
+    // res.Error exactly like they always do -- mirroring how contentRPC
+    // special-cases 409 for upload_session's lookup_failed. Anything we
+    // can't decode this way falls through to the generic error handling.
+    if rsp.StatusCode == 409 {
+      if lfr, ok := res.(*ListFolderResult); ok {
+        defer rsp.Body.Close()
+        body, readErr := ioutil.ReadAll(rsp.Body)
+        if readErr == nil {
+          if jerr := json.Unmarshal(body, lfr); jerr == nil && lfr.Error != nil {
+            return false, nil
+          }
+        }
+        return classifyRsp(rsp, body, errors.New(url+": "+string(body)))
+      }
+    }
 
-  defer rsp.Body.Close()
-  return json.NewDecoder(rsp.Body).Decode(&res);
-  
-  // body, err := ioutil.ReadAll(rsp.Body)
-  // if err == nil {
-  //   b := new(bytes.Buffer)
-  //   if json.Indent(b, body, "", "  ") == nil {
-  //     println("response:", b.String())
-  //   }
-  //   err = json.Unmarshal(body, res)
-  // }
-  // return err
+    if retry, err := c.checkRetriableRsp(rsp); retry || err != nil {
+      return retry, err
+    }
+
+    defer rsp.Body.Close()
+    return false, json.NewDecoder(rsp.Body).Decode(&res)
+  })
 }
 
 
@@ -279,25 +367,101 @@ func (c *Client) RPC(url string, msg, res interface{}) error {
 // - "rev:" file rev (e.g. "rev:a1c10ce0dd78")
 // - "/"    file path (e.g. "/Homework/math/Prime_Numbers.txt")
 func (c *Client) Download(identity string) (io.ReadCloser, error) {
+  return c.DownloadCtx(context.Background(), identity)
+}
+
+// DownloadCtx is Download with a context that aborts the in-flight request
+// (and any retries) as soon as it's canceled.
+func (c *Client) DownloadCtx(ctx context.Context, identity string) (io.ReadCloser, error) {
   idbuf, err := json.Marshal(identity)
   if err != nil {
     return nil, err
   }
 
-  req, err := http.NewRequest("GET", downloadURL, nil)
-  req.Header.Add("Authorization", "Bearer " + c.AccessToken)
-  req.Header.Add("Dropbox-API-Arg", "{\"path\":" + string(idbuf) + "}")
+  var body io.ReadCloser
+  err = c.callPacer().Call(func() (bool, error) {
+    rsp, err := c.doAuthed(ctx, func(ctx context.Context, token string) (*http.Request, error) {
+      req, err := http.NewRequestWithContext(ctx, "GET", downloadURL, nil)
+      if err != nil {
+        return nil, err
+      }
+      req.Header.Add("Authorization", "Bearer " + token)
+      req.Header.Add("Dropbox-API-Arg", "{\"path\":" + string(idbuf) + "}")
+      if h := c.pathRoot.header(); h != "" {
+        req.Header.Add("Dropbox-API-Path-Root", h)
+      }
+      return req, nil
+    })
+    if err != nil {
+      if ctx.Err() != nil {
+        return false, ctx.Err()
+      }
+      return true, err
+    }
+
+    if retry, err := c.checkRetriableRsp(rsp); retry || err != nil {
+      return retry, err
+    }
 
-  rsp, err := c.client.Do(req)
+    body = rsp.Body
+    return false, nil
+  })
   if err != nil {
     return nil, err
   }
+  return body, nil
+}
+
+// DownloadVerified is Download, but also verifies the downloaded content
+// against entry.ContentHash, returning ErrContentHashMismatch from the
+// returned ReadCloser's Close (after the caller has read it to EOF) if they
+// don't match. If entry.ContentHash is empty, no verification is done.
+func (c *Client) DownloadVerified(identity string, entry *FolderEntry) (io.ReadCloser, error) {
+  return c.DownloadVerifiedCtx(context.Background(), identity, entry)
+}
 
-  if err := c.checkRsp(rsp, 200, 299); err != nil {
+// DownloadVerifiedCtx is DownloadVerified with a context that aborts the
+// in-flight request (and any retries) as soon as it's canceled.
+func (c *Client) DownloadVerifiedCtx(ctx context.Context, identity string, entry *FolderEntry) (io.ReadCloser, error) {
+  body, err := c.DownloadCtx(ctx, identity)
+  if err != nil {
     return nil, err
   }
+  if entry.ContentHash == "" {
+    return body, nil
+  }
+  return &verifyingReadCloser{body: body, hash: dbhash.New(), want: entry.ContentHash}, nil
+}
+
+// ErrContentHashMismatch is returned by verifyingReadCloser.Close when the
+// downloaded content's dbhash doesn't match the expected ContentHash.
+const ErrContentHashMismatch = Error("dbxapi: downloaded content_hash mismatch")
+
+// verifyingReadCloser tees reads through a dbhash.Hash and checks the
+// result against want once the caller closes it, having presumably read it
+// to EOF first.
+type verifyingReadCloser struct {
+  body io.ReadCloser
+  hash hash.Hash
+  want string
+}
+
+func (v *verifyingReadCloser) Read(p []byte) (int, error) {
+  n, err := v.body.Read(p)
+  if n > 0 {
+    v.hash.Write(p[:n])
+  }
+  return n, err
+}
 
-  return rsp.Body, nil
+func (v *verifyingReadCloser) Close() error {
+  if err := v.body.Close(); err != nil {
+    return err
+  }
+  if hex.EncodeToString(v.hash.Sum(nil)) != v.want {
+    return ErrContentHashMismatch
+  }
+  return nil
 }
 
 
@@ -310,11 +474,18 @@ type ListFolderReq struct {
   
   IncludeDeleted                  bool `json:"include_deleted"`
   IncludeHasExplicitSharedMembers bool `json:"include_has_explicit_shared_members"`
+
+  // IncludeContentHash asks the server to populate FolderEntry.ContentHash.
+  IncludeContentHash bool `json:"include_content_hash"`
 }
 
 func (r ListFolderReq) Send(c Client) (*ListFolderResult, error) {
+  return r.SendCtx(context.Background(), c)
+}
+
+func (r ListFolderReq) SendCtx(ctx context.Context, c Client) (*ListFolderResult, error) {
   var res ListFolderResult
-  err := c.RPC(apiURLPrefix + "files/list_folder", r, &res)
+  err := c.RPCCtx(ctx, apiURLPrefix + "files/list_folder", r, &res)
   return &res, err
 }
 
@@ -324,8 +495,12 @@ type ListFolderContReq struct {
 }
 
 func (r ListFolderContReq) Send(c Client) (*ListFolderResult, error) {
+  return r.SendCtx(context.Background(), c)
+}
+
+func (r ListFolderContReq) SendCtx(ctx context.Context, c Client) (*ListFolderResult, error) {
   var res ListFolderResult
-  err := c.RPC(apiURLPrefix + "files/list_folder/continue", r, &res)
+  err := c.RPCCtx(ctx, apiURLPrefix + "files/list_folder/continue", r, &res)
   return &res, err
 }
 
@@ -341,7 +516,11 @@ type ListFolderLongpollReq struct {
 }
 
 func (r ListFolderLongpollReq) Send(c Client) (*ListFolderLongPollResult, error) {
+  return r.SendCtx(context.Background(), c)
+}
+
+func (r ListFolderLongpollReq) SendCtx(ctx context.Context, c Client) (*ListFolderLongPollResult, error) {
   var res ListFolderLongPollResult
-  err := c.RPC(notifyURLPrefix + "files/list_folder/longpoll", r, &res)
+  err := c.RPCCtx(ctx, notifyURLPrefix + "files/list_folder/longpoll", r, &res)
   return &res, err
 }
@@ -1,12 +1,13 @@
 package dbxapi
 
 import (
+  "context"
+  "errors"
+  "sync"
   "time"
   //"encoding/json"
 )
 
-const ErrCanceled = Error("canceled")
-
 type DirMode int
 const (
   DirModeShallow   = DirMode(iota)
@@ -14,11 +15,14 @@ const (
 )
 
 type FolderWatcher struct {
-  hasMore  bool
-  exitch   chan error
-  cancelch chan struct{}
-  canceled bool
-  changecb func(FolderChanges)
+  hasMore    bool
+  exitch     chan error
+  changecb   func(FolderChanges)
+  resetDepth int // >0 while one or more nested handleReset calls are resyncing full state
+
+  mu       sync.Mutex
+  cancel   context.CancelFunc
+  canceled bool // Cancel was called; setCancel applies it if that was before Run started
 
   Client
   Cursor        string
@@ -34,10 +38,8 @@ func NewFolderWatcher(client *Client, path string, m DirMode) *FolderWatcher {
     return nil
   }
   exitch := make(chan error)
-  cancelch := make(chan struct{},1)
   w := FolderWatcher{
     exitch: exitch,
-    cancelch: cancelch,
     Client: *client,
     Path: path,
     DirMode: m,
@@ -55,66 +57,141 @@ type FolderChanges struct {
   Removed []string
 }
 
-// Returns true if call caused w to be cancel. False is already canceled.
+// Cancel stops a running Run by canceling the context it derived from the
+// one it was given. If Run hasn't been started yet, the cancellation is
+// remembered and applied as soon as it does start, so a Cancel issued
+// right after construction (or racing with a not-yet-scheduled `go
+// w.Run(...)`) is never lost.
 func (w *FolderWatcher) Cancel() {
-  w.cancelch <- struct{}{}
-}
-
-func (w *FolderWatcher) checkCanceled() bool {
-  if w.canceled {
-    return true
-  }
-  select {
-    case <-w.cancelch:
-      w.canceled = true
-      return true
-    default:
-      return false
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  w.canceled = true
+  if w.cancel != nil {
+    w.cancel()
   }
 }
 
-func (w *FolderWatcher) checkCanceledAndExit() bool {
-  if w.checkCanceled() {
-    w.exitch <- ErrCanceled
-    return true
+func (w *FolderWatcher) setCancel(cancel context.CancelFunc) {
+  w.mu.Lock()
+  defer w.mu.Unlock()
+  w.cancel = cancel
+  if w.canceled {
+    cancel()
   }
-  return false
 }
 
 
-func (w *FolderWatcher) checkResult(r *ListFolderResult, err error) bool {
+// checkResult applies r to the watcher's state. ok is false if the caller
+// should stop (either a terminal error was pushed to Exit, or reset is true
+// and the caller should run handleReset instead).
+func (w *FolderWatcher) checkResult(r *ListFolderResult, err error) (ok, reset bool) {
   if err != nil {
     w.exitch <- err
-    return false
-  }
-  if w.checkCanceledAndExit() {
-    return false
+    return false, false
   }
 
   // b, _ := json.MarshalIndent(r, "", "  ")
   // println("interpreted:", string(b))
 
+  if r.Error != nil {
+    if r.Error.Tag == "reset" {
+      return false, true
+    }
+    w.exitch <- errors.New("dbxapi: " + r.ErrorSummary)
+    return false, false
+  }
+
   w.Cursor = r.Cursor
   w.hasMore = r.HasMore
 
-  return true
+  return true, false
 }
 
+// notify invokes changecb with changes, unless handleReset is in the
+// middle of resyncing full state (in which case it will emit its own,
+// deduplicated FolderChanges once the outermost resync is complete).
+func (w *FolderWatcher) notify(changes FolderChanges) {
+  if w.resetDepth > 0 {
+    return
+  }
+  if len(changes.Added) > 0 || len(changes.Updated) > 0 || len(changes.Removed) > 0 {
+    w.changecb(changes)
+  }
+}
+
+// handleReset rebuilds the watcher's state from scratch after the server
+// tells us our cursor is no longer valid, then diffs the fresh listing
+// against the snapshot of what we had before so callers see one coherent
+// FolderChanges instead of everything vanishing and reappearing as new.
+//
+// The resync itself pages through fetchInitial/fetch, either of which can
+// recurse into another handleReset if a second reset lands mid-pagination.
+// resetDepth tracks how many handleReset calls are currently nested so
+// that only the outermost one snapshots state up front and emits the
+// final notify: an inner call takes no snapshot, resyncs and discards the
+// state rebuilt so far (a reset means "start over", so a second one mid-resync
+// invalidates whatever partial progress the outer call had made), leaving
+// the outer call's pre-reset snapshot as the correct baseline to diff the
+// final state against.
+func (w *FolderWatcher) handleReset(ctx context.Context) bool {
+  w.resetDepth++
+  outermost := w.resetDepth == 1
+
+  var snapshot map[string]*FolderEntry
+  if outermost {
+    snapshot = w.EntriesById
+  }
+
+  w.Cursor = ""
+  w.EntriesById = make(map[string]*FolderEntry)
+  w.EntriesByPath = make(map[string]*FolderEntry)
+
+  ok := w.fetchInitial(ctx)
+  for ok && w.hasMore {
+    ok = w.fetch(ctx)
+  }
+  w.resetDepth--
+  if !ok {
+    return false
+  }
+
+  if outermost {
+    w.notify(diffEntries(snapshot, w.EntriesById))
+  }
+  return true
+}
 
-// TODO: reset state when API response tells us to
-// func (w *FolderWatcher) reset() bool {
-//   w.Cursor = ""
-//   w.EntriesById = make(map[string]*FolderEntry)
-//   w.EntriesByPath = make(map[string]*FolderEntry)
-// }
+// diffEntries compares two EntriesById snapshots and reports which ids were
+// added, removed, or changed (different Rev or PathLower) between them.
+func diffEntries(before, after map[string]*FolderEntry) FolderChanges {
+  var changes FolderChanges
+  for id, ent := range after {
+    prev, existed := before[id]
+    if !existed {
+      changes.Added = append(changes.Added, id)
+    } else if prev.Rev != ent.Rev || prev.PathLower != ent.PathLower {
+      changes.Updated = append(changes.Updated, id)
+    }
+  }
+  for id := range before {
+    if _, stillThere := after[id]; !stillThere {
+      changes.Removed = append(changes.Removed, id)
+    }
+  }
+  return changes
+}
 
 
-func (w *FolderWatcher) fetchInitial() bool {
+func (w *FolderWatcher) fetchInitial(ctx context.Context) bool {
   r, err := ListFolderReq{
     Path: w.Path,
     Recursive: w.DirMode == DirModeRecursive,
-  }.Send(w.Client)
-  if !w.checkResult(r, err) {
+  }.SendCtx(ctx, w.Client)
+  ok, reset := w.checkResult(r, err)
+  if reset {
+    return w.handleReset(ctx)
+  }
+  if !ok {
     return false
   }
   if len(r.Entries) > 0 {
@@ -124,19 +201,23 @@ func (w *FolderWatcher) fetchInitial() bool {
       w.EntriesByPath[ent.PathLower] = ent
       changes.Added[i] = ent.Id
     }
-    w.changecb(changes)
+    w.notify(changes)
   }
   return true
 }
 
 
-func (w *FolderWatcher) fetch() bool {
+func (w *FolderWatcher) fetch(ctx context.Context) bool {
   if w.Cursor == "" {
-    return w.fetchInitial()
+    return w.fetchInitial(ctx)
   }
 
-  r, err := ListFolderContReq{Cursor: w.Cursor}.Send(w.Client)
-  if !w.checkResult(r, err) {
+  r, err := ListFolderContReq{Cursor: w.Cursor}.SendCtx(ctx, w.Client)
+  ok, reset := w.checkResult(r, err)
+  if reset {
+    return w.handleReset(ctx)
+  }
+  if !ok {
     return false
   }
 
@@ -149,7 +230,7 @@ func (w *FolderWatcher) fetch() bool {
   // Map of deleted entries, keyed by file id.
   // We coalesce "deleted" followed by "added"; for true deleted, fill delm.
   delm := make(map[string]string) // value=PathLower for truly deleted
-  
+
   for _, ent := range r.Entries {
     prevEntAtPath := w.EntriesByPath[ent.PathLower]
     if ent.Tag == "deleted" {
@@ -197,28 +278,31 @@ func (w *FolderWatcher) fetch() bool {
     i++
   }
 
-  if len(changes.Added) > 0 ||
-     len(changes.Updated) > 0 ||
-     len(changes.Removed) > 0 {
-    w.changecb(changes)
-  }
+  w.notify(changes)
 
   return true
 }
 
 
-func (w *FolderWatcher) waitForChanges() bool {
+func (w *FolderWatcher) waitForChanges(ctx context.Context) bool {
   for {
-    r, err := ListFolderLongpollReq{Cursor: w.Cursor, Timeout: 30}.Send(w.Client)
+    // Errors here include path/not_found (the watched path was deleted or
+    // moved out from under us); that's not recoverable by a reset like
+    // list_folder/continue's is, so it's surfaced as a terminal error.
+    r, err := ListFolderLongpollReq{Cursor: w.Cursor, Timeout: 30}.SendCtx(ctx, w.Client)
     if err != nil {
       w.exitch <- err
       return false
     }
-    if w.checkCanceledAndExit() {
-      return false
-    }
     if r.Backoff > 0 {
-      time.Sleep(time.Duration(r.Backoff) * time.Second)
+      timer := time.NewTimer(time.Duration(r.Backoff) * time.Second)
+      select {
+      case <-timer.C:
+      case <-ctx.Done():
+        timer.Stop()
+        w.exitch <- ctx.Err()
+        return false
+      }
     }
     if r.Changes {
       w.hasMore = true
@@ -228,20 +312,28 @@ func (w *FolderWatcher) waitForChanges() bool {
 }
 
 
-func (w *FolderWatcher) Run(changecb func(FolderChanges)) {
+// Run drives the watcher until ctx is canceled or an unrecoverable error
+// occurs, in either case reporting the reason through Exit. Cancel() is a
+// wrapper around canceling a context.CancelFunc derived from ctx here, so
+// canceling aborts whatever request (including a pending longpoll) is
+// currently in flight instead of waiting for it to return on its own.
+func (w *FolderWatcher) Run(ctx context.Context, changecb func(FolderChanges)) {
+  ctx, cancel := context.WithCancel(ctx)
+  defer cancel()
+  w.setCancel(cancel)
   w.changecb = changecb
 
   for {
     for {
-      if !w.fetch() {
+      if !w.fetch(ctx) {
         return
       }
       if !w.hasMore {
         break
       }
     }
-    if !w.waitForChanges() {
+    if !w.waitForChanges(ctx) {
       return
     }
   }
-}
\ No newline at end of file
+}
@@ -0,0 +1,286 @@
+package dbxapi
+
+import (
+  "bytes"
+  "context"
+  "encoding/json"
+  "io/ioutil"
+  "net/http"
+  "sort"
+  "strings"
+  "testing"
+  "time"
+
+  "golang.org/x/oauth2"
+)
+
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+func jsonResponse(v interface{}) *http.Response {
+  return statusResponse(200, v)
+}
+
+// statusResponse builds a fake response the way Dropbox actually sends
+// business-logic errors: the JSON body is always an error or result struct,
+// but errors come back with a non-2xx status (409 for RPC endpoints), not
+// as a 200 with Result.Error populated.
+func statusResponse(status int, v interface{}) *http.Response {
+  b, _ := json.Marshal(v)
+  return &http.Response{
+    StatusCode: status,
+    Body:       ioutil.NopCloser(bytes.NewReader(b)),
+    Header:     make(http.Header),
+  }
+}
+
+func fakeClient(t *testing.T, rt roundTripFunc) Client {
+  return Client{
+    client: http.Client{Transport: rt},
+    pacer:  NewPacer(),
+    ts:     &cachingTokenSource{base: oauth2.StaticTokenSource(&oauth2.Token{AccessToken: "test"})},
+  }
+}
+
+func sorted(ss []string) []string {
+  out := append([]string(nil), ss...)
+  sort.Strings(out)
+  return out
+}
+
+// TestFolderWatcherHandlesReset verifies that when list_folder/continue
+// reports a "reset" error mid-stream, the watcher resyncs its full state
+// and reports one coherent FolderChanges instead of making entries that
+// were present all along look like they vanished and reappeared.
+func TestFolderWatcherHandlesReset(t *testing.T) {
+  entryA := &FolderEntry{Tag: "file", Id: "id:a", Name: "a.txt", PathLower: "/a.txt", Rev: "1"}
+  entryB := &FolderEntry{Tag: "file", Id: "id:b", Name: "b.txt", PathLower: "/b.txt", Rev: "1"}
+  entryC := &FolderEntry{Tag: "file", Id: "id:c", Name: "c.txt", PathLower: "/c.txt", Rev: "1"}
+
+  listCalls := 0
+  contCalls := 0
+
+  client := fakeClient(t, roundTripFunc(func(r *http.Request) (*http.Response, error) {
+    switch {
+    case strings.HasSuffix(r.URL.Path, "/files/list_folder"):
+      listCalls++
+      if listCalls == 1 {
+        // Initial listing, before the reset.
+        return jsonResponse(ListFolderResult{
+          Entries: []*FolderEntry{entryA, entryB},
+          Cursor:  "cursor-1",
+        }), nil
+      }
+      // Resync after the reset: A is gone, B is unchanged, C is new.
+      return jsonResponse(ListFolderResult{
+        Entries: []*FolderEntry{entryB, entryC},
+        Cursor:  "cursor-2",
+      }), nil
+
+    case strings.HasSuffix(r.URL.Path, "/files/list_folder/continue"):
+      contCalls++
+      return statusResponse(409, ListFolderResult{
+        Result: Result{Error: &APIError{Tag: "reset"}, ErrorSummary: "reset/..."},
+      }), nil
+    }
+    t.Fatalf("unexpected request: %s", r.URL.String())
+    return nil, nil
+  }))
+
+  w := NewFolderWatcher(&client, "/", DirModeShallow)
+  var got []FolderChanges
+  w.changecb = func(c FolderChanges) { got = append(got, c) }
+
+  ctx := context.Background()
+  if !w.fetchInitial(ctx) {
+    t.Fatalf("fetchInitial failed: %v", <-w.Exit)
+  }
+  if len(got) != 1 {
+    t.Fatalf("expected 1 notification after initial fetch, got %d", len(got))
+  }
+
+  if !w.fetch(ctx) {
+    t.Fatalf("fetch (triggering reset) failed: %v", <-w.Exit)
+  }
+  if contCalls != 1 {
+    t.Fatalf("expected exactly 1 list_folder/continue call, got %d", contCalls)
+  }
+  if listCalls != 2 {
+    t.Fatalf("expected exactly 2 list_folder calls (initial + resync), got %d", listCalls)
+  }
+
+  if len(got) != 2 {
+    t.Fatalf("expected 1 notification from the reset resync, got %d total notifications", len(got))
+  }
+  resetChanges := got[1]
+
+  if added := sorted(resetChanges.Added); len(added) != 1 || added[0] != "id:c" {
+    t.Errorf("Added = %v, want [id:c]", added)
+  }
+  if removed := sorted(resetChanges.Removed); len(removed) != 1 || removed[0] != "id:a" {
+    t.Errorf("Removed = %v, want [id:a]", removed)
+  }
+  if len(resetChanges.Updated) != 0 {
+    t.Errorf("Updated = %v, want none (id:b didn't change)", resetChanges.Updated)
+  }
+
+  if _, stillThere := w.EntriesById["id:a"]; stillThere {
+    t.Errorf("id:a should have been removed from EntriesById after reset")
+  }
+  if _, present := w.EntriesById["id:c"]; !present {
+    t.Errorf("id:c should be present in EntriesById after reset")
+  }
+}
+
+// TestFolderWatcherHandlesNestedReset verifies that a second reset landing
+// mid-pagination of the first reset's resync doesn't cause an intermediate,
+// incorrect FolderChanges to be emitted before the correct one -- only the
+// outermost handleReset call notifies, diffing against the state from
+// before the first reset.
+func TestFolderWatcherHandlesNestedReset(t *testing.T) {
+  entryA := &FolderEntry{Tag: "file", Id: "id:a", Name: "a.txt", PathLower: "/a.txt", Rev: "1"}
+  entryB := &FolderEntry{Tag: "file", Id: "id:b", Name: "b.txt", PathLower: "/b.txt", Rev: "1"}
+  entryC := &FolderEntry{Tag: "file", Id: "id:c", Name: "c.txt", PathLower: "/c.txt", Rev: "1"}
+  entryD := &FolderEntry{Tag: "file", Id: "id:d", Name: "d.txt", PathLower: "/d.txt", Rev: "1"}
+
+  listCalls := 0
+  contCalls := 0
+
+  client := fakeClient(t, roundTripFunc(func(r *http.Request) (*http.Response, error) {
+    switch {
+    case strings.HasSuffix(r.URL.Path, "/files/list_folder"):
+      listCalls++
+      switch listCalls {
+      case 1:
+        // Initial listing, before any reset.
+        return jsonResponse(ListFolderResult{
+          Entries: []*FolderEntry{entryA, entryB},
+          Cursor:  "cursor-0",
+        }), nil
+      case 2:
+        // First page of the first reset's resync; has more pages.
+        return jsonResponse(ListFolderResult{
+          Entries: []*FolderEntry{entryB, entryC},
+          Cursor:  "cursor-1",
+          HasMore: true,
+        }), nil
+      default:
+        // First (and only) page of the second reset's resync.
+        return jsonResponse(ListFolderResult{
+          Entries: []*FolderEntry{entryC, entryD},
+          Cursor:  "cursor-2",
+        }), nil
+      }
+
+    case strings.HasSuffix(r.URL.Path, "/files/list_folder/continue"):
+      contCalls++
+      // Both continues hit a reset: the first one kicks off the outer
+      // resync, the second lands while that resync is still paging.
+      return statusResponse(409, ListFolderResult{
+        Result: Result{Error: &APIError{Tag: "reset"}, ErrorSummary: "reset/..."},
+      }), nil
+    }
+    t.Fatalf("unexpected request: %s", r.URL.String())
+    return nil, nil
+  }))
+
+  w := NewFolderWatcher(&client, "/", DirModeShallow)
+  var got []FolderChanges
+  w.changecb = func(c FolderChanges) { got = append(got, c) }
+
+  ctx := context.Background()
+  if !w.fetchInitial(ctx) {
+    t.Fatalf("fetchInitial failed: %v", <-w.Exit)
+  }
+  if !w.fetch(ctx) {
+    t.Fatalf("fetch (triggering nested reset) failed: %v", <-w.Exit)
+  }
+
+  if contCalls != 2 {
+    t.Fatalf("expected exactly 2 list_folder/continue calls, got %d", contCalls)
+  }
+  if listCalls != 3 {
+    t.Fatalf("expected exactly 3 list_folder calls, got %d", listCalls)
+  }
+  if len(got) != 2 {
+    t.Fatalf("expected exactly 2 notifications (initial + one coherent resync), got %d: %+v", len(got), got)
+  }
+
+  resetChanges := got[1]
+  if added := sorted(resetChanges.Added); len(added) != 2 || added[0] != "id:c" || added[1] != "id:d" {
+    t.Errorf("Added = %v, want [id:c id:d]", added)
+  }
+  if removed := sorted(resetChanges.Removed); len(removed) != 2 || removed[0] != "id:a" || removed[1] != "id:b" {
+    t.Errorf("Removed = %v, want [id:a id:b]", removed)
+  }
+  if len(resetChanges.Updated) != 0 {
+    t.Errorf("Updated = %v, want none", resetChanges.Updated)
+  }
+}
+
+// TestFolderWatcherCancelBeforeRun verifies that calling Cancel() before
+// Run() has set up its context isn't lost -- Run should still exit
+// promptly once started, rather than running to completion (or, for a
+// real longpoll, hanging for up to 30s) as if it had never been canceled.
+func TestFolderWatcherCancelBeforeRun(t *testing.T) {
+  client := fakeClient(t, roundTripFunc(func(r *http.Request) (*http.Response, error) {
+    if err := r.Context().Err(); err != nil {
+      return nil, err
+    }
+    t.Fatalf("unexpected request: %s", r.URL.String())
+    return nil, nil
+  }))
+
+  w := NewFolderWatcher(&client, "/", DirModeShallow)
+  w.Cancel()
+
+  go w.Run(context.Background(), func(FolderChanges) {})
+
+  select {
+  case err := <-w.Exit:
+    if err == nil {
+      t.Errorf("expected a non-nil error from Exit")
+    }
+  case <-time.After(time.Second):
+    t.Fatalf("Run did not exit promptly after a Cancel() issued before it started")
+  }
+}
+
+// TestFolderWatcherCancelDuringBackoff verifies that a Cancel() landing
+// while Run is sleeping out a server-requested longpoll backoff aborts
+// that sleep immediately instead of blocking Run until it elapses.
+func TestFolderWatcherCancelDuringBackoff(t *testing.T) {
+  client := fakeClient(t, roundTripFunc(func(r *http.Request) (*http.Response, error) {
+    switch {
+    case strings.HasSuffix(r.URL.Path, "/files/list_folder/continue"):
+      return jsonResponse(ListFolderResult{Cursor: "seed"}), nil
+    case strings.HasSuffix(r.URL.Path, "/files/list_folder/longpoll"):
+      // A backoff far longer than this test should ever wait out.
+      return jsonResponse(ListFolderLongPollResult{Backoff: 30}), nil
+    }
+    t.Fatalf("unexpected request: %s", r.URL.String())
+    return nil, nil
+  }))
+
+  w := NewFolderWatcher(&client, "/", DirModeShallow)
+  w.Cursor = "seed"
+
+  go w.Run(context.Background(), func(FolderChanges) {})
+
+  time.Sleep(20 * time.Millisecond) // let Run reach the backoff sleep
+  start := time.Now()
+  w.Cancel()
+
+  select {
+  case err := <-w.Exit:
+    if err == nil {
+      t.Errorf("expected a non-nil error from Exit")
+    }
+  case <-time.After(time.Second):
+    t.Fatalf("Run did not exit promptly after Cancel() during a backoff sleep")
+  }
+  if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+    t.Errorf("Run took %v to exit after Cancel(), want well under the 30s backoff", elapsed)
+  }
+}
@@ -0,0 +1,205 @@
+package dbxapi
+
+import (
+  "context"
+  "crypto/rand"
+  "crypto/sha256"
+  "encoding/base64"
+  "encoding/json"
+  "io/ioutil"
+  "net/http"
+  "net/url"
+  "sync"
+  "time"
+
+  "golang.org/x/oauth2"
+)
+
+const (
+  oauthAuthorizeURL = "https://www.dropbox.com/oauth2/authorize"
+  oauthTokenURL     = "https://api.dropboxapi.com/oauth2/token"
+)
+
+// cachingTokenSource wraps an oauth2.TokenSource with a cache that Client
+// can explicitly invalidate after a 401, forcing the next Token() call to
+// go back to base rather than return the token cached here. Any caching
+// that base does itself (e.g. oauth2.ReuseTokenSource) is not bypassed, so
+// such a base may return the same token again until it expires.
+type cachingTokenSource struct {
+  mu   sync.Mutex
+  base oauth2.TokenSource
+  tok  *oauth2.Token
+}
+
+func (s *cachingTokenSource) Token() (*oauth2.Token, error) {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  if s.tok != nil && s.tok.Valid() {
+    return s.tok, nil
+  }
+  t, err := s.base.Token()
+  if err != nil {
+    return nil, err
+  }
+  s.tok = t
+  return t, nil
+}
+
+func (s *cachingTokenSource) invalidate() {
+  s.mu.Lock()
+  defer s.mu.Unlock()
+  s.tok = nil
+}
+
+func (c *Client) accessToken() (string, error) {
+  if c.ts == nil {
+    return "", Error("dbxapi: client has no token source; use NewClient or NewClientWithTokenSource")
+  }
+  t, err := c.ts.Token()
+  if err != nil {
+    return "", err
+  }
+  return t.AccessToken, nil
+}
+
+// forceTokenRefresh discards the cached access token so the next request
+// asks the underlying oauth2.TokenSource for a fresh one. It's a no-op on
+// a Client with no token source.
+func (c *Client) forceTokenRefresh() {
+  if c.ts == nil {
+    return
+  }
+  c.ts.invalidate()
+}
+
+// doAuthed performs an authenticated HTTP request, retrying exactly once if
+// the server returns 401 by forcing a token refresh first. newReq must
+// build a fresh *http.Request every time it's called (via
+// http.NewRequestWithContext(ctx, ...)), since a 401 retry needs to resend
+// the request body and ctx cancellation needs to reach every attempt.
+func (c *Client) doAuthed(ctx context.Context, newReq func(ctx context.Context, token string) (*http.Request, error)) (*http.Response, error) {
+  token, err := c.accessToken()
+  if err != nil {
+    return nil, err
+  }
+  req, err := newReq(ctx, token)
+  if err != nil {
+    return nil, err
+  }
+  rsp, err := c.client.Do(req)
+  if err != nil {
+    return nil, err
+  }
+  if rsp.StatusCode != 401 {
+    return rsp, nil
+  }
+  rsp.Body.Close()
+
+  c.forceTokenRefresh()
+  token, err = c.accessToken()
+  if err != nil {
+    return nil, err
+  }
+  req, err = newReq(ctx, token)
+  if err != nil {
+    return nil, err
+  }
+  return c.client.Do(req)
+}
+
+// PKCEAuthCodeFlow drives Dropbox's authorization-code-with-PKCE flow so an
+// application can obtain a refresh token without embedding a client secret
+// or depending on a browser-launching helper: call AuthCodeURL, have the
+// user open it and approve access, then pass the code they're redirected
+// back with to Exchange.
+type PKCEAuthCodeFlow struct {
+  ClientID    string
+  RedirectURI string
+
+  verifier string
+}
+
+// NewPKCEAuthCodeFlow generates a fresh PKCE code verifier for one
+// authorization attempt.
+func NewPKCEAuthCodeFlow(clientID, redirectURI string) (*PKCEAuthCodeFlow, error) {
+  verifier, err := randomCodeVerifier()
+  if err != nil {
+    return nil, err
+  }
+  return &PKCEAuthCodeFlow{ClientID: clientID, RedirectURI: redirectURI, verifier: verifier}, nil
+}
+
+// AuthCodeURL builds the /oauth2/authorize URL to send the user to. state,
+// if non-empty, is round-tripped back in the redirect so callers can
+// correlate it with the request that started the flow.
+func (f *PKCEAuthCodeFlow) AuthCodeURL(state string) string {
+  v := url.Values{}
+  v.Set("client_id", f.ClientID)
+  v.Set("redirect_uri", f.RedirectURI)
+  v.Set("response_type", "code")
+  v.Set("token_access_type", "offline")
+  v.Set("code_challenge", codeChallengeS256(f.verifier))
+  v.Set("code_challenge_method", "S256")
+  if state != "" {
+    v.Set("state", state)
+  }
+  return oauthAuthorizeURL + "?" + v.Encode()
+}
+
+// Exchange trades the code the user was redirected back with for an
+// oauth2.Token, including a refresh token since AuthCodeURL requested
+// token_access_type=offline.
+func (f *PKCEAuthCodeFlow) Exchange(code string) (*oauth2.Token, error) {
+  v := url.Values{}
+  v.Set("code", code)
+  v.Set("grant_type", "authorization_code")
+  v.Set("client_id", f.ClientID)
+  v.Set("redirect_uri", f.RedirectURI)
+  v.Set("code_verifier", f.verifier)
+
+  rsp, err := http.PostForm(oauthTokenURL, v)
+  if err != nil {
+    return nil, err
+  }
+  defer rsp.Body.Close()
+
+  var tr struct {
+    AccessToken  string `json:"access_token"`
+    RefreshToken string `json:"refresh_token"`
+    TokenType    string `json:"token_type"`
+    ExpiresIn    int64  `json:"expires_in"`
+  }
+  body, err := ioutil.ReadAll(rsp.Body)
+  if err != nil {
+    return nil, err
+  }
+  if rsp.StatusCode < 200 || rsp.StatusCode > 299 {
+    return nil, Error("oauth2/token: " + rsp.Status + ": " + string(body))
+  }
+  if err := json.Unmarshal(body, &tr); err != nil {
+    return nil, err
+  }
+
+  tok := &oauth2.Token{
+    AccessToken:  tr.AccessToken,
+    RefreshToken: tr.RefreshToken,
+    TokenType:    tr.TokenType,
+  }
+  if tr.ExpiresIn > 0 {
+    tok.Expiry = time.Now().Add(time.Duration(tr.ExpiresIn) * time.Second)
+  }
+  return tok, nil
+}
+
+func randomCodeVerifier() (string, error) {
+  b := make([]byte, 32)
+  if _, err := rand.Read(b); err != nil {
+    return "", err
+  }
+  return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func codeChallengeS256(verifier string) string {
+  sum := sha256.Sum256([]byte(verifier))
+  return base64.RawURLEncoding.EncodeToString(sum[:])
+}
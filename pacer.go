@@ -0,0 +1,139 @@
+package dbxapi
+
+import (
+  "encoding/json"
+  "net/http"
+  "strconv"
+  "sync"
+  "time"
+)
+
+// Pacer paces and retries calls to the Dropbox API. fn performs one attempt
+// and reports whether the call is worth retrying (retry) along with the
+// error from that attempt (which is returned as-is if retry is false, or if
+// the retry budget has been exhausted).
+type Pacer interface {
+  Call(fn func() (retry bool, err error)) error
+}
+
+// retryAfter is implemented by errors that know exactly how long to wait
+// before the next attempt, e.g. from a Retry-After header or a rate_limit
+// error body. A DefaultPacer honors this instead of its own backoff curve.
+type retryAfter interface {
+  RetryAfter() time.Duration
+}
+
+type retryAfterError struct {
+  error
+  after time.Duration
+}
+
+func (e *retryAfterError) RetryAfter() time.Duration { return e.after }
+
+// DefaultPacer is a token-bucket style pacer modeled on rclone's: it keeps a
+// single current sleep duration, shared by all callers, that grows
+// exponentially on retriable errors (up to MaxSleep) and decays back down
+// (divided by DecayConstant) after each success.
+type DefaultPacer struct {
+  MinSleep      time.Duration
+  MaxSleep      time.Duration
+  DecayConstant uint
+  MaxRetries    int
+
+  mu        sync.Mutex
+  sleepTime time.Duration
+}
+
+// NewPacer returns a DefaultPacer with rclone-like defaults: 10ms minimum
+// sleep, 2 minute maximum sleep, decay constant 2, up to 10 retries.
+func NewPacer() *DefaultPacer {
+  return &DefaultPacer{
+    MinSleep:      10 * time.Millisecond,
+    MaxSleep:      2 * time.Minute,
+    DecayConstant: 2,
+    MaxRetries:    10,
+    sleepTime:     10 * time.Millisecond,
+  }
+}
+
+func (p *DefaultPacer) Call(fn func() (bool, error)) error {
+  var retry bool
+  var err error
+  for try := 0; try <= p.MaxRetries; try++ {
+    retry, err = fn()
+    if !retry {
+      p.decay()
+      return err
+    }
+    if try == p.MaxRetries {
+      break
+    }
+    time.Sleep(p.nextSleep(err))
+  }
+  return err
+}
+
+func (p *DefaultPacer) nextSleep(err error) time.Duration {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  if ra, ok := err.(retryAfter); ok {
+    if d := ra.RetryAfter(); d > 0 {
+      p.sleepTime = d
+      return d
+    }
+  }
+  p.sleepTime *= 2
+  if p.sleepTime > p.MaxSleep {
+    p.sleepTime = p.MaxSleep
+  }
+  return p.sleepTime
+}
+
+func (p *DefaultPacer) decay() {
+  p.mu.Lock()
+  defer p.mu.Unlock()
+  p.sleepTime /= time.Duration(p.DecayConstant)
+  if p.sleepTime < p.MinSleep {
+    p.sleepTime = p.MinSleep
+  }
+}
+
+type rateLimitErrorBody struct {
+  ErrorSummary string `json:"error_summary"`
+  Error        struct {
+    Tag        string `json:".tag"`
+    RetryAfter uint64 `json:"retry_after"`
+  } `json:"error"`
+}
+
+func parseRetryAfter(rsp *http.Response, body []byte) time.Duration {
+  if v := rsp.Header.Get("Retry-After"); v != "" {
+    if secs, err := strconv.Atoi(v); err == nil && secs > 0 {
+      return time.Duration(secs) * time.Second
+    }
+  }
+  var eb rateLimitErrorBody
+  if err := json.Unmarshal(body, &eb); err == nil {
+    if eb.Error.Tag == "rate_limit" || eb.Error.Tag == "too_many_requests" {
+      if eb.Error.RetryAfter > 0 {
+        return time.Duration(eb.Error.RetryAfter) * time.Second
+      }
+    }
+  }
+  return 0
+}
+
+// classifyRsp reports whether rsp's status code warrants a retry (429, 503,
+// or any other 5xx) and returns an error describing the response. For 429
+// and 503 the error also carries a RetryAfter duration parsed from the
+// Retry-After header or a rate_limit/too_many_requests error body, which
+// Pacer implementations can use instead of their own backoff.
+func classifyRsp(rsp *http.Response, body []byte, baseErr error) (retry bool, err error) {
+  if rsp.StatusCode == 429 || rsp.StatusCode == 503 {
+    return true, &retryAfterError{error: baseErr, after: parseRetryAfter(rsp, body)}
+  }
+  if rsp.StatusCode >= 500 && rsp.StatusCode <= 599 {
+    return true, baseErr
+  }
+  return false, baseErr
+}
@@ -0,0 +1,108 @@
+package dbxapi
+
+import (
+  "context"
+  "io"
+  "net/http"
+  "testing"
+  "time"
+)
+
+// TestClassifyRspParsesRetryAfter verifies that a 429 response carrying a
+// Retry-After header comes back as a retriable error whose RetryAfter()
+// matches the header, so DefaultPacer can honor it instead of its own
+// backoff curve.
+func TestClassifyRspParsesRetryAfter(t *testing.T) {
+  rsp := &http.Response{
+    StatusCode: 429,
+    Header:     http.Header{"Retry-After": []string{"7"}},
+  }
+  retry, err := classifyRsp(rsp, nil, nil)
+  if !retry {
+    t.Fatalf("expected classifyRsp to report retry=true for a 429")
+  }
+  ra, ok := err.(retryAfter)
+  if !ok {
+    t.Fatalf("expected err to implement retryAfter, got %T", err)
+  }
+  if got, want := ra.RetryAfter(), 7*time.Second; got != want {
+    t.Errorf("RetryAfter() = %v, want %v", got, want)
+  }
+}
+
+// TestClassifyRspParsesRetryAfterFromBody verifies the rate_limit error body
+// fallback used when the server has no Retry-After header.
+func TestClassifyRspParsesRetryAfterFromBody(t *testing.T) {
+  rsp := &http.Response{StatusCode: 429, Header: make(http.Header)}
+  body := []byte(`{"error_summary": "too_many_requests/...", "error": {".tag": "too_many_requests", "retry_after": 3}}`)
+  retry, err := classifyRsp(rsp, body, nil)
+  if !retry {
+    t.Fatalf("expected classifyRsp to report retry=true for a 429")
+  }
+  ra, ok := err.(retryAfter)
+  if !ok {
+    t.Fatalf("expected err to implement retryAfter, got %T", err)
+  }
+  if got, want := ra.RetryAfter(), 3*time.Second; got != want {
+    t.Errorf("RetryAfter() = %v, want %v", got, want)
+  }
+}
+
+// TestPacerHonorsRetryAfterOverOwnCurve verifies that DefaultPacer sleeps for
+// exactly the duration carried by a retryAfter error instead of its own
+// exponential backoff curve, and that the curve resumes from that point
+// rather than from where it left off.
+func TestPacerHonorsRetryAfterOverOwnCurve(t *testing.T) {
+  p := NewPacer()
+
+  // With no retryAfter, nextSleep doubles the current sleepTime.
+  d := p.nextSleep(context.Canceled)
+  if want := 20 * time.Millisecond; d != want {
+    t.Fatalf("nextSleep with a plain error = %v, want %v (doubled from MinSleep)", d, want)
+  }
+
+  // A retryAfter error overrides the curve with its own duration, and that
+  // duration becomes the new sleepTime rather than being doubled.
+  const retryAfterDur = 5 * time.Second
+  d = p.nextSleep(&retryAfterError{error: context.Canceled, after: retryAfterDur})
+  if d != retryAfterDur {
+    t.Fatalf("nextSleep with a retryAfter error = %v, want %v", d, retryAfterDur)
+  }
+
+  d = p.nextSleep(context.Canceled)
+  if want := 2 * retryAfterDur; d != want {
+    t.Fatalf("nextSleep after a retryAfter error = %v, want %v (doubled from the retryAfter duration)", d, want)
+  }
+}
+
+// TestPacerCallUsesRetryAfterDuration exercises Call end-to-end: a fn that
+// fails once with a retryAfter error of a few milliseconds should make Call
+// sleep approximately that long, not the pacer's own (larger, by default)
+// backoff curve.
+func TestPacerCallUsesRetryAfterDuration(t *testing.T) {
+  p := NewPacer()
+  p.MinSleep = 50 * time.Millisecond
+  p.sleepTime = 50 * time.Millisecond
+
+  const retryAfterDur = 5 * time.Millisecond
+  tries := 0
+  start := time.Now()
+  err := p.Call(func() (bool, error) {
+    tries++
+    if tries == 1 {
+      return true, &retryAfterError{error: io.EOF, after: retryAfterDur}
+    }
+    return false, nil
+  })
+  elapsed := time.Since(start)
+
+  if err != nil {
+    t.Fatalf("Call returned %v, want nil", err)
+  }
+  if tries != 2 {
+    t.Fatalf("fn called %d times, want 2", tries)
+  }
+  if elapsed > 40*time.Millisecond {
+    t.Errorf("Call took %v, want well under MinSleep (%v), since it should have honored the %v retryAfter instead", elapsed, p.MinSleep, retryAfterDur)
+  }
+}
@@ -0,0 +1,111 @@
+package dbxapi
+
+import (
+  "encoding/json"
+)
+
+// PathRoot selects which root a request's paths are relative to, via the
+// Dropbox-API-Path-Root header. This matters for Business accounts, where
+// paths are otherwise interpreted relative to the user's own home
+// namespace rather than a team space or shared namespace.
+type PathRoot struct {
+  // Tag is one of "home", "root", or "namespace_id".
+  Tag string
+
+  // Root is the namespace ID this PathRoot refers to. Unused for "home".
+  Root string
+}
+
+// HomePathRoot selects the signed-in user's home namespace, which is the
+// default when a Client has no PathRoot set at all.
+func HomePathRoot() PathRoot {
+  return PathRoot{Tag: "home"}
+}
+
+// RootPathRoot selects namespaceID as the root, failing the request if
+// namespaceID isn't the user's current root namespace (e.g. because their
+// team has since reassigned them to a different one). Dropbox recommends
+// this over NamespaceIDPathRoot so that such a reassignment can be
+// detected rather than silently operating on the wrong namespace.
+func RootPathRoot(namespaceID string) PathRoot {
+  return PathRoot{Tag: "root", Root: namespaceID}
+}
+
+// NamespaceIDPathRoot selects namespace id as the root unconditionally.
+func NamespaceIDPathRoot(id string) PathRoot {
+  return PathRoot{Tag: "namespace_id", Root: id}
+}
+
+func (pr PathRoot) MarshalJSON() ([]byte, error) {
+  switch pr.Tag {
+  case "root":
+    return json.Marshal(struct {
+      Tag  string `json:".tag"`
+      Root string `json:"root"`
+    }{pr.Tag, pr.Root})
+  case "namespace_id":
+    return json.Marshal(struct {
+      Tag         string `json:".tag"`
+      NamespaceId string `json:"namespace_id"`
+    }{pr.Tag, pr.Root})
+  default:
+    return json.Marshal(struct {
+      Tag string `json:".tag"`
+    }{"home"})
+  }
+}
+
+// header returns the Dropbox-API-Path-Root header value for pr, or "" if
+// pr is the zero value (meaning no header should be sent).
+func (pr PathRoot) header() string {
+  if pr.Tag == "" {
+    return ""
+  }
+  b, err := json.Marshal(pr)
+  if err != nil {
+    return ""
+  }
+  return string(b)
+}
+
+// ErrInvalidPathRoot is returned when the server rejects a request's
+// Dropbox-API-Path-Root header, e.g. because a Client.WithPathRoot(RootPathRoot(...))
+// namespace is no longer the caller's root namespace. SuggestedPathRoot is
+// the path root the server reports the caller should use instead; retry
+// the request against a Client built with
+// c.WithPathRoot(err.SuggestedPathRoot).
+type ErrInvalidPathRoot struct {
+  SuggestedPathRoot PathRoot
+}
+
+func (e *ErrInvalidPathRoot) Error() string {
+  return "dbxapi: invalid path root, server suggests " + e.SuggestedPathRoot.header()
+}
+
+// pathRootErrorBody mirrors the 422 response Dropbox sends for
+// path/invalid_path_root, e.g.:
+//   {"error_summary": "invalid_root/...",
+//    "error": {".tag": "invalid_root",
+//               "root_info": {".tag": "team", "root_namespace_id": "3235641"}}}
+type pathRootErrorBody struct {
+  Error struct {
+    Tag      string `json:".tag"`
+    RootInfo *struct {
+      Tag             string `json:".tag"`
+      RootNamespaceId string `json:"root_namespace_id"`
+    } `json:"root_info"`
+  } `json:"error"`
+}
+
+// parseInvalidPathRoot returns an *ErrInvalidPathRoot if body is a 422
+// path/invalid_path_root response, or nil otherwise.
+func parseInvalidPathRoot(statusCode int, body []byte) *ErrInvalidPathRoot {
+  if statusCode != 422 {
+    return nil
+  }
+  var eb pathRootErrorBody
+  if err := json.Unmarshal(body, &eb); err != nil || eb.Error.Tag != "invalid_root" || eb.Error.RootInfo == nil {
+    return nil
+  }
+  return &ErrInvalidPathRoot{SuggestedPathRoot: NamespaceIDPathRoot(eb.Error.RootInfo.RootNamespaceId)}
+}
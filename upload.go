@@ -0,0 +1,355 @@
+package dbxapi
+
+import (
+  "bytes"
+  "context"
+  "encoding/json"
+  "io"
+  "net/http"
+)
+
+const (
+  contentURLPrefix = "https://content.dropboxapi.com/2/"
+
+  // DefaultChunkSize is used by Client.Upload when UploadOpts.ChunkSize is zero.
+  DefaultChunkSize = 48 * 1024 * 1024
+
+  // maxSingleShotUploadSize is Dropbox's limit for files/upload; anything
+  // larger (or of unknown length) must go through an upload session.
+  maxSingleShotUploadSize = 150 * 1024 * 1024
+)
+
+type UploadMode string
+
+const (
+  UploadModeAdd       = UploadMode("add")
+  UploadModeOverwrite = UploadMode("overwrite")
+)
+
+// UploadCommit describes the destination of an upload (files/upload and
+// files/upload_session/finish both take one of these as "commit").
+type UploadCommit struct {
+  Path           string     `json:"path"`
+  Mode           UploadMode `json:"mode"`
+  Autorename     bool       `json:"autorename"`
+  Mute           bool       `json:"mute"`
+  ClientModified *Timestamp `json:"client_modified,omitempty"`
+}
+
+// UploadOpts configures Client.Upload.
+type UploadOpts struct {
+  Mode           UploadMode
+  Autorename     bool
+  Mute           bool
+  ClientModified *Timestamp
+
+  // ChunkSize controls both the read buffer size and, indirectly, whether
+  // Upload picks a single-shot or a session upload: if the reader reaches
+  // EOF before filling ChunkSize bytes and what it produced is within the
+  // 150 MB single-shot limit, a single files/upload request is used.
+  // Defaults to DefaultChunkSize.
+  ChunkSize uint64
+}
+
+func (o UploadOpts) commit(dst string) UploadCommit {
+  mode := o.Mode
+  if mode == "" {
+    mode = UploadModeAdd
+  }
+  return UploadCommit{
+    Path:           dst,
+    Mode:           mode,
+    Autorename:     o.Autorename,
+    Mute:           o.Mute,
+    ClientModified: o.ClientModified,
+  }
+}
+
+// UploadSessionCursor identifies an upload session and how many bytes have
+// been appended to it so far.
+type UploadSessionCursor struct {
+  SessionId string `json:"session_id"`
+  Offset    uint64 `json:"offset"`
+}
+
+// UploadSessionLookupError is returned when append_v2 or finish reject the
+// cursor, e.g. because a previous append only partially succeeded.
+// Tag is one of "incorrect_offset", "closed", "not_found", "not_closed" or
+// "too_large"; CorrectOffset is only meaningful for "incorrect_offset".
+type UploadSessionLookupError struct {
+  Tag           string `json:".tag"`
+  CorrectOffset uint64 `json:"correct_offset"`
+}
+
+func (e *UploadSessionLookupError) Error() string {
+  return "upload_session/lookup_failed: " + e.Tag
+}
+
+type uploadErrorBody struct {
+  ErrorSummary string `json:"error_summary"`
+  Error        struct {
+    Tag          string                    `json:".tag"`
+    LookupFailed *UploadSessionLookupError `json:"lookup_failed"`
+  } `json:"error"`
+}
+
+// UploadSession lets callers append data in chunks and finish the upload
+// once all of it has been sent. Use Client.NewUploadSession to create one,
+// or just call Client.Upload which drives a session for large/unbounded
+// readers automatically.
+type UploadSession struct {
+  client    *Client
+  sessionId string
+  offset    uint64
+}
+
+// Offset returns the number of bytes successfully appended so far.
+func (s *UploadSession) Offset() uint64 { return s.offset }
+
+// contentRPC drives one of the content.dropboxapi.com upload endpoints,
+// retrying through the client's shared Pacer just like RPC and Download do.
+// bodyBytes is re-read on every attempt, so retries re-send the chunk. ctx
+// aborts the in-flight request (and any retries) as soon as it's canceled.
+func (c *Client) contentRPC(ctx context.Context, url string, arg interface{}, bodyBytes []byte, res interface{}) error {
+  argb, err := json.Marshal(arg)
+  if err != nil {
+    return err
+  }
+
+  return c.callPacer().Call(func() (bool, error) {
+    rsp, err := c.doAuthed(ctx, func(ctx context.Context, token string) (*http.Request, error) {
+      req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(bodyBytes))
+      if err != nil {
+        return nil, err
+      }
+      req.Header.Add("Authorization", "Bearer "+token)
+      req.Header.Add("Dropbox-API-Arg", string(argb))
+      req.Header.Add("Content-Type", "application/octet-stream")
+      if h := c.pathRoot.header(); h != "" {
+        req.Header.Add("Dropbox-API-Path-Root", h)
+      }
+      req.ContentLength = int64(len(bodyBytes))
+      return req, nil
+    })
+    if err != nil {
+      if ctx.Err() != nil {
+        return false, ctx.Err()
+      }
+      return true, err
+    }
+
+    if rsp.StatusCode == 409 {
+      defer rsp.Body.Close()
+      var eb uploadErrorBody
+      if err := json.NewDecoder(rsp.Body).Decode(&eb); err == nil && eb.Error.LookupFailed != nil {
+        return false, eb.Error.LookupFailed
+      }
+    }
+    if retry, err := c.checkRetriableRsp(rsp); retry || err != nil {
+      return retry, err
+    }
+
+    defer rsp.Body.Close()
+    if res == nil {
+      return false, nil
+    }
+    return false, json.NewDecoder(rsp.Body).Decode(res)
+  })
+}
+
+// NewUploadSession starts a new files/upload_session for streaming a large
+// or unbounded-length upload in chunks via Append and Finish.
+func (c *Client) NewUploadSession() (*UploadSession, error) {
+  return c.NewUploadSessionCtx(context.Background())
+}
+
+// NewUploadSessionCtx is NewUploadSession with a context that aborts the
+// in-flight request (and any retries) as soon as it's canceled.
+func (c *Client) NewUploadSessionCtx(ctx context.Context) (*UploadSession, error) {
+  var res struct {
+    SessionId string `json:"session_id"`
+  }
+  arg := struct {
+    Close bool `json:"close"`
+  }{Close: false}
+  if err := c.contentRPC(ctx, contentURLPrefix+"files/upload_session/start", arg, nil, &res); err != nil {
+    return nil, err
+  }
+  return &UploadSession{client: c, sessionId: res.SessionId}, nil
+}
+
+// Append uploads the next chunk of the session. If the server reports that
+// a previous append only partially landed (lookup_failed.incorrect_offset),
+// Append resumes from the reported offset, re-sending only the bytes that
+// are still missing.
+func (s *UploadSession) Append(chunk []byte) error {
+  return s.AppendCtx(context.Background(), chunk)
+}
+
+// AppendCtx is Append with a context that aborts the in-flight request (and
+// any retries or resumes) as soon as it's canceled.
+func (s *UploadSession) AppendCtx(ctx context.Context, chunk []byte) error {
+  for {
+    cursor := UploadSessionCursor{SessionId: s.sessionId, Offset: s.offset}
+    arg := struct {
+      Cursor UploadSessionCursor `json:"cursor"`
+      Close  bool                `json:"close"`
+    }{Cursor: cursor, Close: false}
+
+    err := s.client.contentRPC(ctx, contentURLPrefix+"files/upload_session/append_v2", arg, chunk, nil)
+    if err == nil {
+      s.offset += uint64(len(chunk))
+      return nil
+    }
+
+    if le, ok := err.(*UploadSessionLookupError); ok && le.Tag == "incorrect_offset" && le.CorrectOffset >= s.offset {
+      skip := le.CorrectOffset - s.offset
+      if skip > uint64(len(chunk)) {
+        return err
+      }
+      s.offset = le.CorrectOffset
+      chunk = chunk[skip:]
+      if len(chunk) == 0 {
+        return nil
+      }
+      continue
+    }
+    return err
+  }
+}
+
+// Finish closes the session and commits the uploaded bytes as a file.
+func (s *UploadSession) Finish(commit UploadCommit) (*FolderEntry, error) {
+  return s.FinishCtx(context.Background(), commit)
+}
+
+// FinishCtx is Finish with a context that aborts the in-flight request (and
+// any retries) as soon as it's canceled.
+func (s *UploadSession) FinishCtx(ctx context.Context, commit UploadCommit) (*FolderEntry, error) {
+  arg := struct {
+    Cursor UploadSessionCursor `json:"cursor"`
+    Commit UploadCommit        `json:"commit"`
+  }{Cursor: UploadSessionCursor{SessionId: s.sessionId, Offset: s.offset}, Commit: commit}
+
+  var res FolderEntry
+  err := s.client.contentRPC(ctx, contentURLPrefix+"files/upload_session/finish", arg, nil, &res)
+  return &res, err
+}
+
+// UploadSessionFinishArg pairs a session cursor with its destination commit,
+// for use with Client.UploadSessionFinishBatch.
+type UploadSessionFinishArg struct {
+  Cursor UploadSessionCursor `json:"cursor"`
+  Commit UploadCommit        `json:"commit"`
+}
+
+// UploadSessionFinishBatchResult mirrors files/upload_session/finish_batch's
+// async result: either the batch already completed (Tag == "complete" and
+// Entries is populated) or it's still running and must be polled with
+// UploadSessionFinishBatchCheck(AsyncJobId).
+type UploadSessionFinishBatchResult struct {
+  Tag        string                                `json:".tag"`
+  AsyncJobId string                                `json:"async_job_id"`
+  Entries    []UploadSessionFinishBatchEntryResult `json:"entries"`
+}
+
+type UploadSessionFinishBatchEntryResult struct {
+  Tag     string       `json:".tag"` // "success" or "failure"
+  Success *FolderEntry `json:"success"`
+}
+
+// UploadSessionFinishBatch commits many upload sessions at once. Dropbox
+// processes the batch asynchronously for anything but the smallest inputs,
+// so callers should poll UploadSessionFinishBatchCheck until Tag ==
+// "complete" when Tag comes back "async_job_id".
+func (c *Client) UploadSessionFinishBatch(entries []UploadSessionFinishArg) (*UploadSessionFinishBatchResult, error) {
+  return c.UploadSessionFinishBatchCtx(context.Background(), entries)
+}
+
+// UploadSessionFinishBatchCtx is UploadSessionFinishBatch with a context
+// that aborts the in-flight request (and any retries) as soon as it's
+// canceled.
+func (c *Client) UploadSessionFinishBatchCtx(ctx context.Context, entries []UploadSessionFinishArg) (*UploadSessionFinishBatchResult, error) {
+  arg := struct {
+    Entries []UploadSessionFinishArg `json:"entries"`
+  }{Entries: entries}
+  var res UploadSessionFinishBatchResult
+  err := c.RPCCtx(ctx, apiURLPrefix+"files/upload_session/finish_batch", arg, &res)
+  return &res, err
+}
+
+// UploadSessionFinishBatchCheck polls the status of a batch started with
+// UploadSessionFinishBatch.
+func (c *Client) UploadSessionFinishBatchCheck(asyncJobId string) (*UploadSessionFinishBatchResult, error) {
+  return c.UploadSessionFinishBatchCheckCtx(context.Background(), asyncJobId)
+}
+
+// UploadSessionFinishBatchCheckCtx is UploadSessionFinishBatchCheck with a
+// context that aborts the in-flight request (and any retries) as soon as
+// it's canceled.
+func (c *Client) UploadSessionFinishBatchCheckCtx(ctx context.Context, asyncJobId string) (*UploadSessionFinishBatchResult, error) {
+  arg := struct {
+    AsyncJobId string `json:"async_job_id"`
+  }{AsyncJobId: asyncJobId}
+  var res UploadSessionFinishBatchResult
+  err := c.RPCCtx(ctx, apiURLPrefix+"files/upload_session/finish_batch/check", arg, &res)
+  return &res, err
+}
+
+// Upload uploads the content read from r to dst, picking a single-shot
+// files/upload request when r reaches EOF before filling one chunk (and the
+// data is within the single-shot limit) and a chunked
+// upload session (files/upload_session/start, append_v2, finish)
+// otherwise. This lets callers stream io.Readers of unknown length and
+// files larger than Dropbox's 150 MB single-shot limit.
+func (c *Client) Upload(dst string, r io.Reader, opts UploadOpts) (*FolderEntry, error) {
+  return c.UploadCtx(context.Background(), dst, r, opts)
+}
+
+// UploadCtx is Upload with a context that aborts the in-flight request (and
+// any retries) as soon as it's canceled. This is the longest-running call
+// in the client -- a large upload is many sequential chunk requests -- so
+// it's the one most worth being able to cancel mid-flight.
+func (c *Client) UploadCtx(ctx context.Context, dst string, r io.Reader, opts UploadOpts) (*FolderEntry, error) {
+  chunkSize := opts.ChunkSize
+  if chunkSize == 0 {
+    chunkSize = DefaultChunkSize
+  }
+  commit := opts.commit(dst)
+
+  buf := make([]byte, chunkSize)
+  n, err := io.ReadFull(r, buf)
+  eof := err == io.EOF || err == io.ErrUnexpectedEOF
+  if err != nil && !eof {
+    return nil, err
+  }
+
+  if eof && uint64(n) <= maxSingleShotUploadSize {
+    var res FolderEntry
+    err := c.contentRPC(ctx, contentURLPrefix+"files/upload", commit, buf[:n], &res)
+    return &res, err
+  }
+
+  sess, err := c.NewUploadSessionCtx(ctx)
+  if err != nil {
+    return nil, err
+  }
+  if n > 0 {
+    if err := sess.AppendCtx(ctx, buf[:n]); err != nil {
+      return nil, err
+    }
+  }
+  for !eof {
+    n, err = io.ReadFull(r, buf)
+    eof = err == io.EOF || err == io.ErrUnexpectedEOF
+    if err != nil && !eof {
+      return nil, err
+    }
+    if n > 0 {
+      if err := sess.AppendCtx(ctx, buf[:n]); err != nil {
+        return nil, err
+      }
+    }
+  }
+  return sess.FinishCtx(ctx, commit)
+}
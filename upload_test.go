@@ -0,0 +1,63 @@
+package dbxapi
+
+import (
+  "context"
+  "io/ioutil"
+  "net/http"
+  "strings"
+  "testing"
+)
+
+// TestUploadSessionAppendResumesAfterIncorrectOffset verifies that when
+// append_v2 reports lookup_failed.incorrect_offset (e.g. because a previous
+// attempt's response was lost after the bytes actually landed), Append
+// resends only the bytes the server is still missing instead of the whole
+// chunk, and leaves the session's offset matching what the server reports.
+func TestUploadSessionAppendResumesAfterIncorrectOffset(t *testing.T) {
+  chunk := []byte("0123456789")
+  const correctOffset = 4 // server already has the first 4 bytes
+
+  var gotBodies [][]byte
+  appendCalls := 0
+
+  client := fakeClient(t, roundTripFunc(func(r *http.Request) (*http.Response, error) {
+    if !strings.HasSuffix(r.URL.Path, "/files/upload_session/append_v2") {
+      t.Fatalf("unexpected request: %s", r.URL.String())
+      return nil, nil
+    }
+    appendCalls++
+    body, _ := ioutil.ReadAll(r.Body)
+    gotBodies = append(gotBodies, body)
+
+    if appendCalls == 1 {
+      return statusResponse(409, uploadErrorBody{
+        Error: struct {
+          Tag          string                    `json:".tag"`
+          LookupFailed *UploadSessionLookupError `json:"lookup_failed"`
+        }{
+          Tag:          "lookup_failed",
+          LookupFailed: &UploadSessionLookupError{Tag: "incorrect_offset", CorrectOffset: correctOffset},
+        },
+      }), nil
+    }
+    return jsonResponse(struct{}{}), nil
+  }))
+
+  sess := &UploadSession{client: &client}
+  if err := sess.AppendCtx(context.Background(), chunk); err != nil {
+    t.Fatalf("AppendCtx failed: %v", err)
+  }
+
+  if appendCalls != 2 {
+    t.Fatalf("expected exactly 2 append_v2 calls (initial + resumed), got %d", appendCalls)
+  }
+  if string(gotBodies[0]) != string(chunk) {
+    t.Errorf("first append body = %q, want the full chunk %q", gotBodies[0], chunk)
+  }
+  if want := chunk[correctOffset:]; string(gotBodies[1]) != string(want) {
+    t.Errorf("resumed append body = %q, want only the missing tail %q", gotBodies[1], want)
+  }
+  if sess.offset != uint64(len(chunk)) {
+    t.Errorf("session offset = %d, want %d after a fully-landed append", sess.offset, len(chunk))
+  }
+}